@@ -5,9 +5,13 @@ import (
 	"context"
 	"crypto/aes"
 	"crypto/cipher"
+	"crypto/hmac"
 	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
 	"database/sql"
 	"embed"
+	"encoding/binary"
 	"encoding/hex"
 	"errors"
 	"flag"
@@ -16,21 +20,42 @@ import (
 	"net/http"
 	"os"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/labstack/echo/v4"
 	"github.com/labstack/echo/v4/middleware"
 	_ "github.com/lib/pq"
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/hkdf"
+
+	"github.com/Blaster4385/file-share/server/storage"
 )
 
 const (
-	maxUploadSize = 3 * 1024 * 1024 * 1024 // 3 GB
-	keySize       = 32
-	nonceSize     = 12
+	maxUploadSize      = 3 * 1024 * 1024 * 1024 // 3 GB
+	maxUploadChunkSize = 8 * 1024 * 1024        // server-enforced cap on the client-declared chunkSize
+	keySize            = 32
+	nonceSize          = 12
+	baseNonceSize      = nonceSize - 4   // remaining 4 bytes hold the big-endian frame index
+	framePlainSize     = 1 * 1024 * 1024 // plaintext bytes per stored, independently-decryptable frame
+	uploadExpiryTime   = 24 * time.Hour
+	maxFileExpiresIn   = 30 * 24 * time.Hour
+	maxSignedLinkTTL   = 7 * 24 * time.Hour
+
+	passwordSaltSize = 16
+	keyWrapSaltSize  = 16
+	argon2Time       = 1
+	argon2Memory     = 64 * 1024 // KiB
+	argon2Threads    = 4
 )
 
 var db *sql.DB
 var port string
+var storageFlag string
+var backend storage.Backend
 
 //go:embed all:dist
 var dist embed.FS
@@ -43,17 +68,30 @@ func registerHandlers(e *echo.Echo) {
 		HTML5:      true,
 		Filesystem: http.FS(dist),
 	}))
-	e.Use(middleware.Logger())
+	// Default to ${path} rather than ${uri}: download/file-info requests
+	// still accept ?key=/?password= as a fallback for existing links, and
+	// logging the full query string here would defeat the point of moving
+	// keys to the Authorization header in the first place.
+	e.Use(middleware.LoggerWithConfig(middleware.LoggerConfig{
+		Format: `{"time":"${time_rfc3339}","remote_ip":"${remote_ip}","method":"${method}",` +
+			`"path":"${path}","status":${status},"latency":"${latency_human}"}` + "\n",
+	}))
 	e.Use(middleware.Recover())
 	e.Use(middleware.CORS())
+	e.POST("/upload_init", handleUploadInit)
+	e.GET("/upload_status/:uploadId", handleUploadStatus)
+	e.DELETE("/upload/:uploadId", handleUploadAbort)
 	e.POST("/upload_chunk", handleUploadChunk)
 	e.POST("/upload_complete", handleUploadComplete)
 	e.GET("/download/:id", handleDownload)
 	e.GET("/get/:id", handleGetFileInfo)
+	e.POST("/sign/:id", handleSignDownload)
+	registerP2PHandlers(e)
 }
 
 func main() {
 	flag.StringVar(&port, "port", "8080", "HTTP server port")
+	flag.StringVar(&storageFlag, "storage", "postgres", "storage backend for file frames: postgres|fs|s3")
 	flag.Parse()
 	var err error
 	db, err = initDB()
@@ -62,10 +100,16 @@ func main() {
 	}
 	defer db.Close()
 
+	backend, err = newStorageBackend(storageFlag, db)
+	if err != nil {
+		panic(err)
+	}
+
 	e := echo.New()
 	registerHandlers(e)
 
 	startCleanupScheduler()
+	startP2PCleanupScheduler()
 
 	e.Logger.Fatal(e.Start(":" + port))
 }
@@ -91,33 +135,200 @@ func initDB() (*sql.DB, error) {
 	return db, nil
 }
 
+// newStorageBackend selects where encrypted file frames are stored. The
+// transient per-upload chunks table always lives in Postgres; only the
+// assembled file frames are pluggable, since that is where the 3 GB blobs
+// actually accumulate.
+func newStorageBackend(name string, db *sql.DB) (storage.Backend, error) {
+	switch name {
+	case "postgres":
+		return storage.NewPostgresBackend(db), nil
+	case "fs":
+		root := os.Getenv("FS_STORAGE_ROOT")
+		if root == "" {
+			return nil, errors.New("FS_STORAGE_ROOT must be set when -storage=fs")
+		}
+		return storage.NewFSBackend(root), nil
+	case "s3":
+		endpoint := os.Getenv("S3_ENDPOINT")
+		bucket := os.Getenv("S3_BUCKET")
+		accessKey := os.Getenv("S3_ACCESS_KEY")
+		secretKey := os.Getenv("S3_SECRET_KEY")
+		useSSL := os.Getenv("S3_USE_SSL") != "false"
+
+		client, err := minio.New(endpoint, &minio.Options{
+			Creds:  credentials.NewStaticV4(accessKey, secretKey, ""),
+			Secure: useSSL,
+		})
+		if err != nil {
+			return nil, err
+		}
+		return storage.NewS3Backend(client, bucket), nil
+	default:
+		return nil, fmt.Errorf("unknown storage backend %q", name)
+	}
+}
+
 func createTables(ctx context.Context, db *sql.DB) error {
 	_, err := db.ExecContext(ctx, `
+        CREATE TABLE IF NOT EXISTS uploads (
+            upload_id TEXT PRIMARY KEY,
+            total_size BIGINT NOT NULL,
+            chunk_size INT NOT NULL,
+            chunk_count INT NOT NULL,
+            created_at TIMESTAMPTZ DEFAULT NOW(),
+            expires_at TIMESTAMPTZ NOT NULL
+        );
         CREATE TABLE IF NOT EXISTS chunks (
             upload_id TEXT,
             chunk_index INT,
             chunk_data BYTEA,
+            chunk_sha256 TEXT,
             created_at TIMESTAMPTZ DEFAULT NOW(),
             PRIMARY KEY (upload_id, chunk_index)
         );
         CREATE TABLE IF NOT EXISTS files (
             id TEXT,
-            name TEXT,
             chunk_index INT,
             chunk_data BYTEA,
             created_at TIMESTAMPTZ DEFAULT NOW(),
             PRIMARY KEY (id, chunk_index)
         );
+        CREATE TABLE IF NOT EXISTS files_meta (
+            id TEXT PRIMARY KEY,
+            name TEXT NOT NULL,
+            base_nonce BYTEA NOT NULL,
+            frame_size INT NOT NULL,
+            plaintext_size BIGINT NOT NULL,
+            expires_at TIMESTAMPTZ,
+            max_downloads INT,
+            downloads_used INT NOT NULL DEFAULT 0,
+            one_time BOOLEAN NOT NULL DEFAULT FALSE,
+            password_salt BYTEA,
+            password_hash BYTEA,
+            key_salt BYTEA,
+            wrapped_key BYTEA,
+            created_at TIMESTAMPTZ DEFAULT NOW()
+        );
     `)
 	return err
 }
 
+func handleUploadInit(c echo.Context) error {
+	totalSize, err := strconv.ParseInt(c.FormValue("totalSize"), 10, 64)
+	if err != nil {
+		return handleError(c, fmt.Errorf("invalid total size: %v", err), http.StatusBadRequest)
+	}
+	if totalSize <= 0 || totalSize > maxUploadSize {
+		return handleError(c, errors.New("total size out of range"), http.StatusBadRequest)
+	}
+
+	chunkSize, err := strconv.Atoi(c.FormValue("chunkSize"))
+	if err != nil || chunkSize <= 0 || chunkSize > maxUploadChunkSize {
+		return handleError(c, fmt.Errorf("chunk size must be between 1 and %d bytes", maxUploadChunkSize), http.StatusBadRequest)
+	}
+
+	chunkCount := int((totalSize + int64(chunkSize) - 1) / int64(chunkSize))
+	uploadId := generateID()
+	expiresAt := time.Now().Add(uploadExpiryTime)
+
+	_, err = db.ExecContext(c.Request().Context(),
+		"INSERT INTO uploads (upload_id, total_size, chunk_size, chunk_count, created_at, expires_at) VALUES ($1, $2, $3, $4, NOW(), $5)",
+		uploadId, totalSize, chunkSize, chunkCount, expiresAt)
+	if err != nil {
+		return handleError(c, fmt.Errorf("error creating upload session: %v", err), http.StatusInternalServerError)
+	}
+
+	response := struct {
+		UploadID  string    `json:"uploadId"`
+		ChunkSize int       `json:"chunkSize"`
+		ExpiresAt time.Time `json:"expiresAt"`
+	}{
+		UploadID:  uploadId,
+		ChunkSize: chunkSize,
+		ExpiresAt: expiresAt,
+	}
+
+	return c.JSON(http.StatusOK, response)
+}
+
+func handleUploadStatus(c echo.Context) error {
+	uploadId := c.Param("uploadId")
+
+	rows, err := db.QueryContext(c.Request().Context(), "SELECT chunk_index FROM chunks WHERE upload_id = $1 ORDER BY chunk_index", uploadId)
+	if err != nil {
+		return handleError(c, fmt.Errorf("error reading upload status: %v", err), http.StatusInternalServerError)
+	}
+	defer rows.Close()
+
+	received := []int{}
+	for rows.Next() {
+		var idx int
+		if err := rows.Scan(&idx); err != nil {
+			return handleError(c, fmt.Errorf("error reading upload status: %v", err), http.StatusInternalServerError)
+		}
+		received = append(received, idx)
+	}
+	if err := rows.Err(); err != nil {
+		return handleError(c, fmt.Errorf("error reading upload status: %v", err), http.StatusInternalServerError)
+	}
+
+	response := struct {
+		UploadID       string `json:"uploadId"`
+		ReceivedChunks []int  `json:"receivedChunks"`
+	}{
+		UploadID:       uploadId,
+		ReceivedChunks: received,
+	}
+
+	return c.JSON(http.StatusOK, response)
+}
+
+func handleUploadAbort(c echo.Context) error {
+	uploadId := c.Param("uploadId")
+
+	if _, err := db.ExecContext(c.Request().Context(), "DELETE FROM chunks WHERE upload_id = $1", uploadId); err != nil {
+		return handleError(c, fmt.Errorf("error aborting upload: %v", err), http.StatusInternalServerError)
+	}
+	if _, err := db.ExecContext(c.Request().Context(), "DELETE FROM uploads WHERE upload_id = $1", uploadId); err != nil {
+		return handleError(c, fmt.Errorf("error aborting upload: %v", err), http.StatusInternalServerError)
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+// uploadSession mirrors the subset of an uploads row handlers need to
+// validate chunks against what was actually authorized at /upload_init.
+type uploadSession struct {
+	TotalSize  int64
+	ChunkSize  int
+	ChunkCount int
+}
+
+func getUploadSession(ctx context.Context, uploadId string) (uploadSession, error) {
+	var s uploadSession
+	err := db.QueryRowContext(ctx,
+		"SELECT total_size, chunk_size, chunk_count FROM uploads WHERE upload_id = $1 AND expires_at > NOW()",
+		uploadId).Scan(&s.TotalSize, &s.ChunkSize, &s.ChunkCount)
+	return s, err
+}
+
 func handleUploadChunk(c echo.Context) error {
 	uploadId := c.FormValue("uploadId")
 	chunkIndex, err := strconv.Atoi(c.FormValue("chunkIndex"))
 	if err != nil {
 		return handleError(c, fmt.Errorf("invalid chunk index: %v", err), http.StatusBadRequest)
 	}
+
+	ctx := c.Request().Context()
+	upload, err := getUploadSession(ctx, uploadId)
+	if err != nil {
+		return handleError(c, errors.New("unknown upload session"), http.StatusNotFound)
+	}
+	if chunkIndex < 0 || chunkIndex >= upload.ChunkCount {
+		return handleError(c, fmt.Errorf("chunk index %d out of range for upload of %d chunks", chunkIndex, upload.ChunkCount), http.StatusBadRequest)
+	}
+
 	chunk, err := c.FormFile("chunk")
 	if err != nil {
 		return handleError(c, fmt.Errorf("error getting form file: %v", err), http.StatusBadRequest)
@@ -134,15 +345,23 @@ func handleUploadChunk(c echo.Context) error {
 		return handleError(c, fmt.Errorf("error reading chunk data: %v", err), http.StatusInternalServerError)
 	}
 
-	if err := storeChunkInDB(c.Request().Context(), uploadId, chunkIndex, chunkData); err != nil {
+	sum := sha256.Sum256(chunkData)
+	chunkSHA256 := hex.EncodeToString(sum[:])
+	if want := c.Request().Header.Get("X-Chunk-SHA256"); want != "" && !strings.EqualFold(want, chunkSHA256) {
+		return handleError(c, errors.New("chunk hash mismatch"), http.StatusBadRequest)
+	}
+
+	if err := storeChunkInDB(ctx, uploadId, chunkIndex, chunkData, chunkSHA256); err != nil {
 		return handleError(c, fmt.Errorf("error storing chunk in database: %v", err), http.StatusInternalServerError)
 	}
 
 	return c.NoContent(http.StatusOK)
 }
 
-func storeChunkInDB(ctx context.Context, uploadId string, chunkIndex int, chunkData []byte) error {
-	_, err := db.ExecContext(ctx, "INSERT INTO chunks (upload_id, chunk_index, chunk_data, created_at) VALUES ($1, $2, $3, NOW())", uploadId, chunkIndex, chunkData)
+func storeChunkInDB(ctx context.Context, uploadId string, chunkIndex int, chunkData []byte, chunkSHA256 string) error {
+	_, err := db.ExecContext(ctx,
+		"INSERT INTO chunks (upload_id, chunk_index, chunk_data, chunk_sha256, created_at) VALUES ($1, $2, $3, $4, NOW()) ON CONFLICT (upload_id, chunk_index) DO NOTHING",
+		uploadId, chunkIndex, chunkData, chunkSHA256)
 	return err
 }
 
@@ -154,43 +373,86 @@ func handleUploadComplete(c echo.Context) error {
 	}
 	fileName := c.FormValue("fileName")
 
-	key, err := generateRandomKey()
+	chunkHashes := strings.Split(c.FormValue("chunkHashes"), ",")
+	if len(chunkHashes) != chunkCount {
+		return handleError(c, errors.New("chunkHashes must list one hash per chunk"), http.StatusBadRequest)
+	}
+
+	shareOpts, err := parseShareOptions(c)
 	if err != nil {
-		return handleError(c, fmt.Errorf("error generating encryption key: %v", err), http.StatusInternalServerError)
+		return handleError(c, err, http.StatusBadRequest)
+	}
+
+	ctx := c.Request().Context()
+	upload, err := getUploadSession(ctx, uploadId)
+	if err != nil {
+		return handleError(c, errors.New("unknown upload session"), http.StatusNotFound)
+	}
+	if chunkCount != upload.ChunkCount {
+		return handleError(c, fmt.Errorf("chunkCount %d does not match the %d chunks authorized at upload_init", chunkCount, upload.ChunkCount), http.StatusBadRequest)
 	}
 
-	id := generateID()
 	for i := 0; i < chunkCount; i++ {
-		chunkData, err := getChunkFromDB(c.Request().Context(), uploadId, i)
+		gotSHA256, err := getChunkSHA256FromDB(ctx, uploadId, i)
 		if err != nil {
-			return handleError(c, fmt.Errorf("error retrieving chunk data: %v", err), http.StatusInternalServerError)
+			return handleError(c, fmt.Errorf("error retrieving chunk %d: %v", i, err), http.StatusInternalServerError)
+		}
+		if !strings.EqualFold(gotSHA256, strings.TrimSpace(chunkHashes[i])) {
+			return handleError(c, fmt.Errorf("chunk %d hash does not match, upload is incomplete", i), http.StatusBadRequest)
 		}
+	}
+
+	key, err := generateRandomKey()
+	if err != nil {
+		return handleError(c, fmt.Errorf("error generating encryption key: %v", err), http.StatusInternalServerError)
+	}
+	baseNonce, err := generateBaseNonce()
+	if err != nil {
+		return handleError(c, fmt.Errorf("error generating nonce: %v", err), http.StatusInternalServerError)
+	}
 
-		encryptedData, err := encryptFile(bytes.NewReader(chunkData), key)
+	var pw *passwordProtection
+	if password := c.FormValue("password"); password != "" {
+		pw, err = newPasswordProtection(password, key)
 		if err != nil {
-			return handleError(c, fmt.Errorf("error encrypting chunk: %v", err), http.StatusInternalServerError)
+			return handleError(c, fmt.Errorf("error protecting file with password: %v", err), http.StatusInternalServerError)
 		}
+	}
 
-		if err := storeChunkInFilesTable(c.Request().Context(), id, fileName, i, encryptedData); err != nil {
-			return handleError(c, fmt.Errorf("error storing chunk in database: %v", err), http.StatusInternalServerError)
-		}
+	id := generateID()
+	enc := &frameEncoder{ctx: ctx, id: id, key: key, baseNonce: baseNonce}
+	src := &uploadChunkReader{ctx: ctx, uploadId: uploadId, chunkCount: chunkCount}
+	buf := make([]byte, 32*1024)
+	if _, err := io.CopyBuffer(enc, src, buf); err != nil {
+		return handleError(c, fmt.Errorf("error encrypting upload: %v", err), http.StatusInternalServerError)
+	}
+	if err := enc.flush(); err != nil {
+		return handleError(c, fmt.Errorf("error encrypting upload: %v", err), http.StatusInternalServerError)
+	}
+
+	if err := insertFilesMeta(ctx, id, fileName, baseNonce, enc.total, shareOpts, pw); err != nil {
+		return handleError(c, fmt.Errorf("error storing file metadata: %v", err), http.StatusInternalServerError)
 	}
 
-	encodedKey := hex.EncodeToString(key)
 	response := struct {
 		ID  string `json:"id"`
-		Key string `json:"key"`
+		Key string `json:"key,omitempty"`
 	}{
-		ID:  id,
-		Key: encodedKey,
+		ID: id,
+	}
+	// When a password protects the file, the raw key is never handed back:
+	// it can only be recovered by unwrapping it with the password.
+	if pw == nil {
+		response.Key = hex.EncodeToString(key)
 	}
 
 	return c.JSON(http.StatusOK, response)
 }
 
-func storeChunkInFilesTable(ctx context.Context, id, fileName string, chunkIndex int, encryptedData []byte) error {
-	_, err := db.ExecContext(ctx, "INSERT INTO files (id, name, chunk_index, chunk_data, created_at) VALUES ($1, $2, $3, $4, NOW())", id, fileName, chunkIndex, encryptedData)
-	return err
+func getChunkSHA256FromDB(ctx context.Context, uploadId string, chunkIndex int) (string, error) {
+	var chunkSHA256 string
+	err := db.QueryRowContext(ctx, "SELECT chunk_sha256 FROM chunks WHERE upload_id = $1 AND chunk_index = $2", uploadId, chunkIndex).Scan(&chunkSHA256)
+	return chunkSHA256, err
 }
 
 func getChunkFromDB(ctx context.Context, uploadId string, chunkIndex int) ([]byte, error) {
@@ -199,125 +461,664 @@ func getChunkFromDB(ctx context.Context, uploadId string, chunkIndex int) ([]byt
 	return chunkData, err
 }
 
-func handleDownload(c echo.Context) error {
-	id := c.Param("id")
-	keyHex := c.QueryParam("key")
+// uploadChunkReader streams the raw bytes of a completed upload session by
+// pulling its chunks from the chunks table in order, without ever holding
+// more than one client-sized chunk in memory at a time.
+type uploadChunkReader struct {
+	ctx        context.Context
+	uploadId   string
+	chunkCount int
+	nextChunk  int
+	buf        []byte
+}
 
-	key, err := hex.DecodeString(keyHex)
+func (r *uploadChunkReader) Read(p []byte) (int, error) {
+	for len(r.buf) == 0 {
+		if r.nextChunk >= r.chunkCount {
+			return 0, io.EOF
+		}
+		data, err := getChunkFromDB(r.ctx, r.uploadId, r.nextChunk)
+		if err != nil {
+			return 0, err
+		}
+		r.buf = data
+		r.nextChunk++
+	}
+
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+// frameEncoder is an io.Writer that buffers incoming plaintext into
+// framePlainSize-sized frames, encrypting and persisting each as soon as it
+// fills so the full file is never held in memory.
+type frameEncoder struct {
+	ctx        context.Context
+	id         string
+	key        []byte
+	baseNonce  []byte
+	frameIndex int
+	buf        []byte
+	total      int64
+}
+
+func (f *frameEncoder) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		room := framePlainSize - len(f.buf)
+		n := room
+		if n > len(p) {
+			n = len(p)
+		}
+		f.buf = append(f.buf, p[:n]...)
+		p = p[n:]
+		written += n
+		f.total += int64(n)
+
+		if len(f.buf) == framePlainSize {
+			if err := f.flush(); err != nil {
+				return written, err
+			}
+		}
+	}
+	return written, nil
+}
+
+func (f *frameEncoder) flush() error {
+	if len(f.buf) == 0 {
+		return nil
+	}
+
+	encrypted, err := encryptFrame(f.buf, f.key, f.baseNonce, f.frameIndex)
 	if err != nil {
-		return handleError(c, fmt.Errorf("invalid key: %v", err), http.StatusBadRequest)
+		return err
+	}
+	if err := backend.PutChunk(f.ctx, f.id, f.frameIndex, bytes.NewReader(encrypted)); err != nil {
+		return err
+	}
+
+	f.frameIndex++
+	f.buf = f.buf[:0]
+	return nil
+}
+
+// shareOptions captures the client-controlled sharing restrictions requested
+// for a file at upload time.
+type shareOptions struct {
+	ExpiresAt    sql.NullTime
+	MaxDownloads sql.NullInt32
+	OneTime      bool
+}
+
+// parseShareOptions reads the optional expiresIn/maxDownloads/oneTime form
+// fields. expiresIn is a Go duration string (e.g. "72h") and is capped at
+// maxFileExpiresIn. oneTime sets a max of one download when no maxDownloads
+// was given; an explicit maxDownloads is kept as is.
+func parseShareOptions(c echo.Context) (shareOptions, error) {
+	var opts shareOptions
+
+	if raw := c.FormValue("expiresIn"); raw != "" {
+		d, err := time.ParseDuration(raw)
+		if err != nil || d <= 0 {
+			return opts, fmt.Errorf("invalid expiresIn: %v", err)
+		}
+		if d > maxFileExpiresIn {
+			d = maxFileExpiresIn
+		}
+		opts.ExpiresAt = sql.NullTime{Time: time.Now().Add(d), Valid: true}
 	}
 
-	fileName, err := getFileNameFromDB(c.Request().Context(), id)
+	if raw := c.FormValue("maxDownloads"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n <= 0 {
+			return opts, fmt.Errorf("invalid maxDownloads: %v", err)
+		}
+		opts.MaxDownloads = sql.NullInt32{Int32: int32(n), Valid: true}
+	}
+
+	opts.OneTime = c.FormValue("oneTime") == "true"
+	if opts.OneTime && !opts.MaxDownloads.Valid {
+		opts.MaxDownloads = sql.NullInt32{Int32: 1, Valid: true}
+	}
+
+	return opts, nil
+}
+
+// passwordProtection holds everything needed to verify a password and
+// recover the file's AES key from it, without the raw key ever being stored.
+type passwordProtection struct {
+	PasswordSalt []byte
+	PasswordHash []byte
+	KeySalt      []byte
+	WrappedKey   []byte
+}
+
+// newPasswordProtection hashes password for verification and wraps the
+// file's AES key under a KEK derived from that same password, so only
+// someone who knows the password can recover the key later.
+func newPasswordProtection(password string, fileKey []byte) (*passwordProtection, error) {
+	passwordSalt := make([]byte, passwordSaltSize)
+	if _, err := rand.Read(passwordSalt); err != nil {
+		return nil, err
+	}
+	keySalt := make([]byte, keyWrapSaltSize)
+	if _, err := rand.Read(keySalt); err != nil {
+		return nil, err
+	}
+
+	wrappedKey, err := wrapKey(fileKey, password, keySalt)
 	if err != nil {
-		return handleError(c, fmt.Errorf("error getting file name from database: %v", err), http.StatusInternalServerError)
+		return nil, err
 	}
 
-	c.Response().Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, fileName))
+	return &passwordProtection{
+		PasswordSalt: passwordSalt,
+		PasswordHash: hashPassword(password, passwordSalt),
+		KeySalt:      keySalt,
+		WrappedKey:   wrappedKey,
+	}, nil
+}
+
+func hashPassword(password string, salt []byte) []byte {
+	return argon2.IDKey([]byte(password), salt, argon2Time, argon2Memory, argon2Threads, keySize)
+}
+
+func verifyPassword(password string, salt, hash []byte) bool {
+	return subtle.ConstantTimeCompare(hashPassword(password, salt), hash) == 1
+}
+
+// deriveKEK turns a password into a key-encryption-key via HKDF, scoped to
+// this file by keySalt so the same password never produces the same KEK
+// twice.
+func deriveKEK(password string, keySalt []byte) ([]byte, error) {
+	kek := make([]byte, keySize)
+	h := hkdf.New(sha256.New, []byte(password), keySalt, []byte("file-share-kek"))
+	if _, err := io.ReadFull(h, kek); err != nil {
+		return nil, err
+	}
+	return kek, nil
+}
 
-	err = decryptAndStreamChunks(c.Response(), id, key)
+func wrapKey(fileKey []byte, password string, keySalt []byte) ([]byte, error) {
+	kek, err := deriveKEK(password, keySalt)
 	if err != nil {
-		return handleError(c, fmt.Errorf("error decrypting and streaming file: %v", err), http.StatusInternalServerError)
+		return nil, err
 	}
 
-	return nil
+	block, err := aes.NewCipher(kek)
+	if err != nil {
+		return nil, err
+	}
+	aesgcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, nonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	return aesgcm.Seal(nonce, nonce, fileKey, nil), nil
+}
+
+func unwrapKey(wrapped []byte, password string, keySalt []byte) ([]byte, error) {
+	kek, err := deriveKEK(password, keySalt)
+	if err != nil {
+		return nil, err
+	}
+
+	block, err := aes.NewCipher(kek)
+	if err != nil {
+		return nil, err
+	}
+	aesgcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(wrapped) < nonceSize {
+		return nil, errors.New("wrapped key too short")
+	}
+	nonce, ciphertext := wrapped[:nonceSize], wrapped[nonceSize:]
+
+	return aesgcm.Open(nil, nonce, ciphertext, nil)
+}
+
+func insertFilesMeta(ctx context.Context, id, fileName string, baseNonce []byte, plaintextSize int64, opts shareOptions, pw *passwordProtection) error {
+	var passwordSalt, passwordHash, keySalt, wrappedKey []byte
+	if pw != nil {
+		passwordSalt, passwordHash, keySalt, wrappedKey = pw.PasswordSalt, pw.PasswordHash, pw.KeySalt, pw.WrappedKey
+	}
+
+	_, err := db.ExecContext(ctx,
+		`INSERT INTO files_meta
+            (id, name, base_nonce, frame_size, plaintext_size, expires_at, max_downloads, one_time, password_salt, password_hash, key_salt, wrapped_key, created_at)
+         VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, NOW())`,
+		id, fileName, baseNonce, framePlainSize, plaintextSize, opts.ExpiresAt, opts.MaxDownloads, opts.OneTime,
+		passwordSalt, passwordHash, keySalt, wrappedKey)
+	return err
+}
+
+type fileMeta struct {
+	Name          string
+	BaseNonce     []byte
+	FrameSize     int
+	PlaintextSize int64
+	ExpiresAt     sql.NullTime
+	MaxDownloads  sql.NullInt32
+	DownloadsUsed int32
+	OneTime       bool
+	PasswordSalt  []byte
+	PasswordHash  []byte
+	KeySalt       []byte
+	WrappedKey    []byte
 }
 
-func getFileNameFromDB(ctx context.Context, id string) (fileName string, err error) {
-	err = db.QueryRowContext(ctx, "SELECT name FROM files WHERE id = $1 LIMIT 1", id).Scan(&fileName)
+func (m fileMeta) passwordProtected() bool {
+	return m.PasswordHash != nil
+}
+
+func getFileMeta(ctx context.Context, id string) (fileMeta, error) {
+	var m fileMeta
+	err := db.QueryRowContext(ctx,
+		`SELECT name, base_nonce, frame_size, plaintext_size, expires_at, max_downloads, downloads_used, one_time,
+                password_salt, password_hash, key_salt, wrapped_key
+         FROM files_meta WHERE id = $1`, id).
+		Scan(&m.Name, &m.BaseNonce, &m.FrameSize, &m.PlaintextSize, &m.ExpiresAt, &m.MaxDownloads, &m.DownloadsUsed, &m.OneTime,
+			&m.PasswordSalt, &m.PasswordHash, &m.KeySalt, &m.WrappedKey)
 	if err == sql.ErrNoRows {
-		return "", errors.New("file not found")
+		return m, errors.New("file not found")
+	}
+	return m, err
+}
+
+// resolveFileKey recovers the AES key needed to decrypt a file, either
+// directly from the caller-supplied key or, for password-protected files,
+// by verifying the password and unwrapping the stored key with it.
+func resolveFileKey(meta fileMeta, keyHex, password string) ([]byte, error) {
+	if meta.passwordProtected() {
+		if password == "" {
+			return nil, errors.New("password required")
+		}
+		if !verifyPassword(password, meta.PasswordSalt, meta.PasswordHash) {
+			return nil, errors.New("incorrect password")
+		}
+		return unwrapKey(meta.WrappedKey, password, meta.KeySalt)
+	}
+
+	if keyHex == "" {
+		return nil, errors.New("key required")
 	}
-	return fileName, err
+	return hex.DecodeString(keyHex)
 }
 
-func decryptAndStreamChunks(w io.Writer, id string, key []byte) error {
-	rows, err := db.Query("SELECT chunk_data FROM files WHERE id = $1 ORDER BY chunk_index", id)
+// verifyFileKey confirms key actually decrypts the file's first frame before
+// any caller of resolveFileKey is trusted to consume a download slot. A
+// password-protected file's key already comes from unwrapping with a
+// verified password, so only the raw-key path needs this extra check.
+func verifyFileKey(ctx context.Context, id string, key []byte, meta fileMeta) error {
+	if meta.passwordProtected() {
+		return nil
+	}
+
+	r, err := backend.GetChunk(ctx, id, 0)
 	if err != nil {
 		return err
 	}
-	defer rows.Close()
+	defer r.Close()
 
-	for rows.Next() {
-		var encryptedData []byte
-		if err := rows.Scan(&encryptedData); err != nil {
-			return err
+	encrypted, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+
+	if _, err := decryptFrame(encrypted, key, meta.BaseNonce, 0); err != nil {
+		return errors.New("incorrect key")
+	}
+	return nil
+}
+
+// keyFromRequest reads the decryption key from an Authorization: Bearer
+// header, falling back to the legacy ?key= query parameter so existing
+// links keep working.
+func keyFromRequest(c echo.Context) string {
+	if auth := c.Request().Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		return strings.TrimSpace(strings.TrimPrefix(auth, "Bearer "))
+	}
+	return c.QueryParam("key")
+}
+
+func passwordFromRequest(c echo.Context) string {
+	if password := c.Request().Header.Get("X-File-Password"); password != "" {
+		return password
+	}
+	return c.QueryParam("password")
+}
+
+// fileIsExpired reports whether a file's expiry timestamp has passed.
+func fileIsExpired(m fileMeta) bool {
+	return m.ExpiresAt.Valid && time.Now().After(m.ExpiresAt.Time)
+}
+
+// claimDownload atomically increments a file's download counter as long as
+// it has not yet hit max_downloads, so concurrent downloads of a
+// maxDownloads=1 link can't both succeed.
+func claimDownload(ctx context.Context, id string) (bool, error) {
+	res, err := db.ExecContext(ctx,
+		"UPDATE files_meta SET downloads_used = downloads_used + 1 WHERE id = $1 AND (max_downloads IS NULL OR downloads_used < max_downloads)", id)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// deleteFile removes a file's metadata row and its stored frames.
+func deleteFile(ctx context.Context, id string) error {
+	if err := backend.Delete(ctx, id); err != nil {
+		return err
+	}
+	_, err := db.ExecContext(ctx, "DELETE FROM files_meta WHERE id = $1", id)
+	return err
+}
+
+func handleDownload(c echo.Context) error {
+	id := c.Param("id")
+
+	ctx := c.Request().Context()
+	meta, err := getFileMeta(ctx, id)
+	if err != nil {
+		return handleError(c, fmt.Errorf("error getting file metadata: %v", err), http.StatusInternalServerError)
+	}
+	if fileIsExpired(meta) {
+		return handleError(c, errors.New("file has expired"), http.StatusGone)
+	}
+
+	keyHex := keyFromRequest(c)
+	if err := verifySignedLink(c, id, keyHex); err != nil {
+		return handleError(c, err, http.StatusUnauthorized)
+	}
+
+	key, err := resolveFileKey(meta, keyHex, passwordFromRequest(c))
+	if err != nil {
+		return handleError(c, err, http.StatusUnauthorized)
+	}
+
+	// Prove the caller actually holds a working key before spending a
+	// download/one-time slot on them: decrypting frame 0 is cheap and fails
+	// with a GCM auth error for any key that wasn't the real one, so a
+	// guessed/garbage key can't burn out a limited or one-time link.
+	if err := verifyFileKey(ctx, id, key, meta); err != nil {
+		return handleError(c, err, http.StatusUnauthorized)
+	}
+
+	start, end, partial := parseRange(c.Request().Header.Get("Range"), meta.PlaintextSize)
+
+	// A Range request (resumed download, download-manager split fetch, media
+	// tag probing with bytes=0-1, ...) is one of potentially many HTTP
+	// requests that make up a single logical download, so only a full,
+	// non-partial request consumes a maxDownloads/one-time slot. Otherwise a
+	// two-byte probe could exhaust or delete a one-time link before the real
+	// transfer happens.
+	if !partial {
+		claimed, err := claimDownload(ctx, id)
+		if err != nil {
+			return handleError(c, fmt.Errorf("error claiming download: %v", err), http.StatusInternalServerError)
 		}
+		if !claimed {
+			return handleError(c, errors.New("download limit exceeded"), http.StatusGone)
+		}
+	} else if meta.MaxDownloads.Valid && meta.DownloadsUsed >= meta.MaxDownloads.Int32 {
+		return handleError(c, errors.New("download limit exceeded"), http.StatusGone)
+	}
 
-		plaintext, err := decryptFile(encryptedData, key)
+	res := c.Response()
+	res.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, meta.Name))
+	res.Header().Set("Accept-Ranges", "bytes")
+	res.Header().Set("Content-Length", strconv.FormatInt(end-start+1, 10))
+	if partial {
+		res.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, meta.PlaintextSize))
+		res.WriteHeader(http.StatusPartialContent)
+	} else {
+		res.WriteHeader(http.StatusOK)
+	}
+
+	if meta.OneTime && !partial {
+		res.After(func() {
+			cleanupCtx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			defer cancel()
+			if err := deleteFile(cleanupCtx, id); err != nil {
+				fmt.Printf("error deleting one-time file %s: %v\n", id, err)
+			}
+		})
+	}
+
+	if err := streamFrameRange(ctx, res, id, key, meta, start, end); err != nil {
+		return handleError(c, fmt.Errorf("error decrypting and streaming file: %v", err), http.StatusInternalServerError)
+	}
+
+	return nil
+}
+
+// parseRange interprets an HTTP Range header for a resource of the given
+// size, returning the inclusive byte range to serve and whether the request
+// asked for a sub-range at all. An absent or malformed header serves the
+// whole resource.
+func parseRange(header string, size int64) (start, end int64, partial bool) {
+	const prefix = "bytes="
+	if !strings.HasPrefix(header, prefix) {
+		return 0, size - 1, false
+	}
+
+	parts := strings.SplitN(strings.TrimPrefix(header, prefix), "-", 2)
+	if len(parts) != 2 {
+		return 0, size - 1, false
+	}
+
+	if parts[0] == "" {
+		suffixLen, err := strconv.ParseInt(parts[1], 10, 64)
+		if err != nil || suffixLen <= 0 {
+			return 0, size - 1, false
+		}
+		start = size - suffixLen
+		if start < 0 {
+			start = 0
+		}
+		return start, size - 1, true
+	}
+
+	start, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return 0, size - 1, false
+	}
+
+	if parts[1] == "" {
+		end = size - 1
+	} else {
+		end, err = strconv.ParseInt(parts[1], 10, 64)
+		if err != nil {
+			return 0, size - 1, false
+		}
+		if end >= size {
+			end = size - 1
+		}
+	}
+
+	if start < 0 || start > end {
+		return 0, size - 1, false
+	}
+
+	return start, end, true
+}
+
+// streamFrameRange decrypts only the frames overlapping [start, end] and
+// writes the requested byte range to w.
+func streamFrameRange(ctx context.Context, w io.Writer, id string, key []byte, meta fileMeta, start, end int64) error {
+	startFrame := int(start / int64(meta.FrameSize))
+	endFrame := int(end / int64(meta.FrameSize))
+
+	for frameIndex := startFrame; frameIndex <= endFrame; frameIndex++ {
+		r, err := backend.GetChunk(ctx, id, frameIndex)
+		if err != nil {
+			return err
+		}
+		encrypted, err := io.ReadAll(r)
+		r.Close()
 		if err != nil {
 			return err
 		}
 
-		_, err = w.Write(plaintext)
+		plaintext, err := decryptFrame(encrypted, key, meta.BaseNonce, frameIndex)
 		if err != nil {
 			return err
 		}
+
+		frameStart := int64(frameIndex) * int64(meta.FrameSize)
+		lo, hi := int64(0), int64(len(plaintext))
+		if frameIndex == startFrame {
+			lo = start - frameStart
+		}
+		if frameIndex == endFrame {
+			hi = end - frameStart + 1
+		}
+
+		if _, err := w.Write(plaintext[lo:hi]); err != nil {
+			return err
+		}
 	}
 
-	return rows.Err()
+	return nil
 }
 
 func handleGetFileInfo(c echo.Context) error {
 	id := c.Param("id")
-	keyHex := c.QueryParam("key")
 
-	key, err := hex.DecodeString(keyHex)
+	meta, err := getFileMeta(c.Request().Context(), id)
 	if err != nil {
-		return handleError(c, fmt.Errorf("invalid key: %v", err), http.StatusBadRequest)
+		return handleError(c, fmt.Errorf("error getting file metadata: %v", err), http.StatusInternalServerError)
 	}
-
-	fileName, err := getFileNameFromDB(c.Request().Context(), id)
-	if err != nil {
-		return handleError(c, fmt.Errorf("error getting file name from database: %v", err), http.StatusInternalServerError)
+	if fileIsExpired(meta) {
+		return handleError(c, errors.New("file has expired"), http.StatusGone)
+	}
+	if meta.MaxDownloads.Valid && meta.DownloadsUsed >= meta.MaxDownloads.Int32 {
+		return handleError(c, errors.New("download limit exceeded"), http.StatusGone)
+	}
+	if meta.passwordProtected() {
+		if _, err := resolveFileKey(meta, "", passwordFromRequest(c)); err != nil {
+			return handleError(c, err, http.StatusUnauthorized)
+		}
 	}
 
-	fileSize, err := getTotalFileSize(id, key)
-	if err != nil {
-		return handleError(c, fmt.Errorf("error getting file size: %v", err), http.StatusInternalServerError)
+	var fileSize string
+	if meta.PlaintextSize >= 1024*1024 {
+		fileSize = fmt.Sprintf("%.2f MB", float64(meta.PlaintextSize)/(1024*1024))
+	} else {
+		fileSize = fmt.Sprintf("%.2f KB", float64(meta.PlaintextSize)/1024)
 	}
 
 	fileInfo := struct {
-		FileName string `json:"fileName"`
-		FileSize string `json:"fileSize"`
+		FileName  string `json:"fileName"`
+		FileSize  string `json:"fileSize"`
+		Protected bool   `json:"protected"`
 	}{
-		FileName: fileName,
-		FileSize: fileSize,
+		FileName:  meta.Name,
+		FileSize:  fileSize,
+		Protected: meta.passwordProtected(),
 	}
 
 	return c.JSON(http.StatusOK, fileInfo)
 }
 
-func getTotalFileSize(id string, key []byte) (string, error) {
-	var totalSize int64
-	rows, err := db.Query("SELECT chunk_data FROM files WHERE id = $1 ORDER BY chunk_index", id)
-	if err != nil {
-		return "", err
+// handleSignDownload issues a time-bound signature for a download link so it
+// can be shared without exposing a long-lived key in an Authorization
+// header. The caller supplies the key it already holds; the response's exp
+// and sig query parameters authorize that exact (id, key) pair until exp.
+func handleSignDownload(c echo.Context) error {
+	id := c.Param("id")
+
+	key := c.FormValue("key")
+	if key == "" {
+		return handleError(c, errors.New("key is required"), http.StatusBadRequest)
 	}
-	defer rows.Close()
 
-	for rows.Next() {
-		var encryptedData []byte
-		if err := rows.Scan(&encryptedData); err != nil {
-			return "", err
+	ttl := maxSignedLinkTTL
+	if raw := c.FormValue("expiresIn"); raw != "" {
+		d, err := time.ParseDuration(raw)
+		if err != nil || d <= 0 {
+			return handleError(c, fmt.Errorf("invalid expiresIn: %v", err), http.StatusBadRequest)
 		}
+		ttl = d
+	}
+	if ttl > maxSignedLinkTTL {
+		ttl = maxSignedLinkTTL
+	}
 
-		plaintext, err := decryptFile(encryptedData, key)
-		if err != nil {
-			return "", err
-		}
+	exp := time.Now().Add(ttl).Unix()
+	sig, err := signDownloadLink(id, exp, key)
+	if err != nil {
+		return handleError(c, err, http.StatusInternalServerError)
+	}
 
-		totalSize += int64(len(plaintext))
+	return c.JSON(http.StatusOK, map[string]any{
+		"exp": exp,
+		"sig": hex.EncodeToString(sig),
+	})
+}
+
+// signingSecretKey returns the HMAC key used to sign and verify time-bound
+// download links, configured via the SIGNING_SECRET environment variable.
+func signingSecretKey() ([]byte, error) {
+	secret := os.Getenv("SIGNING_SECRET")
+	if secret == "" {
+		return nil, errors.New("SIGNING_SECRET is not configured")
 	}
+	return []byte(secret), nil
+}
 
-	var fileSize string
-	if totalSize >= 1024*1024 {
-		fileSize = fmt.Sprintf("%.2f MB", float64(totalSize)/(1024*1024))
-	} else {
-		fileSize = fmt.Sprintf("%.2f KB", float64(totalSize)/1024)
+func signDownloadLink(id string, exp int64, key string) ([]byte, error) {
+	secret, err := signingSecretKey()
+	if err != nil {
+		return nil, err
+	}
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(id + "|" + strconv.FormatInt(exp, 10) + "|" + key))
+	return mac.Sum(nil), nil
+}
+
+// verifySignedLink checks an optional exp/sig query pair on a download
+// request against the requested id and key. Requests without a sig skip
+// this check entirely and fall through to the normal key/password checks in
+// resolveFileKey.
+func verifySignedLink(c echo.Context, id, key string) error {
+	sigHex := c.QueryParam("sig")
+	if sigHex == "" {
+		return nil
 	}
 
-	return fileSize, rows.Err()
+	exp, err := strconv.ParseInt(c.QueryParam("exp"), 10, 64)
+	if err != nil {
+		return errors.New("invalid exp")
+	}
+	if time.Now().Unix() > exp {
+		return errors.New("signed link has expired")
+	}
+
+	sig, err := hex.DecodeString(sigHex)
+	if err != nil {
+		return errors.New("invalid sig")
+	}
+
+	expected, err := signDownloadLink(id, exp, key)
+	if err != nil {
+		return err
+	}
+	if !hmac.Equal(sig, expected) {
+		return errors.New("invalid signature")
+	}
+
+	return nil
 }
 
 func handleError(c echo.Context, err error, status int) error {
@@ -337,54 +1138,47 @@ func generateID() string {
 	return hex.EncodeToString(b)
 }
 
-func encryptFile(plaintext io.Reader, key []byte) ([]byte, error) {
-	block, err := aes.NewCipher(key)
-	if err != nil {
-		return nil, err
-	}
+func generateBaseNonce() ([]byte, error) {
+	baseNonce := make([]byte, baseNonceSize)
+	_, err := rand.Read(baseNonce)
+	return baseNonce, err
+}
 
+// deriveNonce builds the per-frame AES-GCM nonce as baseNonce||frameIndex,
+// so every frame of a file gets a unique nonce without storing one per row.
+func deriveNonce(baseNonce []byte, frameIndex int) []byte {
 	nonce := make([]byte, nonceSize)
-	if _, err := rand.Read(nonce); err != nil {
-		return nil, err
-	}
+	copy(nonce, baseNonce)
+	binary.BigEndian.PutUint32(nonce[baseNonceSize:], uint32(frameIndex))
+	return nonce
+}
 
-	aesgcm, err := cipher.NewGCM(block)
+func encryptFrame(plaintext, key, baseNonce []byte, frameIndex int) ([]byte, error) {
+	block, err := aes.NewCipher(key)
 	if err != nil {
 		return nil, err
 	}
 
-	plaintextBytes, err := io.ReadAll(plaintext)
+	aesgcm, err := cipher.NewGCM(block)
 	if err != nil {
 		return nil, err
 	}
 
-	ciphertext := aesgcm.Seal(nonce, nonce, plaintextBytes, nil)
-	return ciphertext, nil
+	return aesgcm.Seal(nil, deriveNonce(baseNonce, frameIndex), plaintext, nil), nil
 }
 
-func decryptFile(ciphertext, key []byte) ([]byte, error) {
+func decryptFrame(ciphertext, key, baseNonce []byte, frameIndex int) ([]byte, error) {
 	block, err := aes.NewCipher(key)
 	if err != nil {
 		return nil, err
 	}
 
-	if len(ciphertext) < nonceSize {
-		return nil, errors.New("ciphertext too short")
-	}
-
-	nonce, ciphertext := ciphertext[:nonceSize], ciphertext[nonceSize:]
-
 	aesgcm, err := cipher.NewGCM(block)
 	if err != nil {
 		return nil, err
 	}
 
-	plaintext, err := aesgcm.Open(nil, nonce, ciphertext, nil)
-	if err != nil {
-		return nil, err
-	}
-
-	return plaintext, nil
+	return aesgcm.Open(nil, deriveNonce(baseNonce, frameIndex), ciphertext, nil)
 }
 
 func startCleanupScheduler() {
@@ -400,8 +1194,90 @@ func cleanupChunks() {
 	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Minute)
 	defer cancel()
 
-	_, err := db.ExecContext(ctx, "DELETE FROM chunks WHERE created_at < NOW() - INTERVAL '1 day'")
+	_, err := db.ExecContext(ctx, "DELETE FROM chunks WHERE upload_id IN (SELECT upload_id FROM uploads WHERE expires_at < NOW())")
 	if err != nil {
 		fmt.Printf("error cleaning up chunks: %v\n", err)
 	}
+
+	if _, err := db.ExecContext(ctx, "DELETE FROM uploads WHERE expires_at < NOW()"); err != nil {
+		fmt.Printf("error cleaning up uploads: %v\n", err)
+	}
+
+	if err := cleanupExpiredFiles(ctx); err != nil {
+		fmt.Printf("error cleaning up expired files: %v\n", err)
+	}
+
+	if err := cleanupOrphanedFrames(ctx); err != nil {
+		fmt.Printf("error cleaning up orphaned frames: %v\n", err)
+	}
+}
+
+// cleanupOrphanedFrames removes frames left behind in the storage backend
+// with no corresponding files_meta row - e.g. a crash between frameEncoder's
+// frame writes and insertFilesMeta. It only considers frames older than
+// uploadExpiryTime so a file whose meta insert simply hasn't committed yet
+// is never touched.
+func cleanupOrphanedFrames(ctx context.Context) error {
+	ids, err := backend.List(ctx, time.Now().Add(-uploadExpiryTime))
+	if err != nil {
+		return err
+	}
+
+	for _, id := range ids {
+		exists, err := fileMetaExists(ctx, id)
+		if err != nil {
+			return err
+		}
+		if exists {
+			continue
+		}
+
+		meta, err := backend.Stat(ctx, id)
+		if err != nil {
+			continue
+		}
+		fmt.Printf("removing %d orphaned frame(s) for %s\n", meta.FrameCount, id)
+
+		if err := backend.Delete(ctx, id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// fileMetaExists reports whether id has a files_meta row, distinguishing
+// "no row" from a real database error so a transient failure here can't be
+// mistaken for an orphan and cause cleanupOrphanedFrames to delete live
+// frames.
+func fileMetaExists(ctx context.Context, id string) (bool, error) {
+	var exists bool
+	err := db.QueryRowContext(ctx, "SELECT EXISTS (SELECT 1 FROM files_meta WHERE id = $1)", id).Scan(&exists)
+	return exists, err
+}
+
+func cleanupExpiredFiles(ctx context.Context) error {
+	rows, err := db.QueryContext(ctx, "SELECT id FROM files_meta WHERE expires_at < NOW()")
+	if err != nil {
+		return err
+	}
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, id := range ids {
+		if err := deleteFile(ctx, id); err != nil {
+			return err
+		}
+	}
+	return nil
 }
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"golang.org/x/net/websocket"
+)
+
+// Direct peer-to-peer transfers never store chunk bytes: the server only
+// relays SDP offers/answers and trickled ICE candidates so two browsers can
+// negotiate an RTCPeerConnection/RTCDataChannel between themselves, with the
+// sender still AES-GCM-encrypting before anything leaves the browser.
+//
+// The code is the only thing standing between a stranger and the sender's
+// SDP/file metadata, so it needs to be large enough that brute-forcing it
+// within p2pSessionTTL is infeasible over the network; 16 random bytes
+// (128 bits) is the same order of magnitude as the session tokens used
+// elsewhere in this codebase. It is not a substitute for a real PAKE
+// (wormhole/croc derive their session key from the code itself, so a
+// brute-forced guess gets you nothing without breaking the crypto too) -
+// that remains a follow-up, tracked separately, along with the frontend
+// "store & forward" vs "direct P2P" toggle and RTCPeerConnection/
+// RTCDataChannel client code, neither of which exist yet in the embedded
+// frontend. Until both land, this endpoint is signaling-only plumbing and
+// should not be advertised to users as a usable transfer mode.
+const (
+	p2pCodeSize    = 16 // bytes of random code, hex-encoded
+	p2pSessionTTL  = 10 * time.Minute
+	p2pSweepPeriod = time.Minute
+)
+
+// p2pSession is the signaling state for one pending transfer. ICE
+// candidates trickled in before the other side's websocket connects are
+// queued and flushed once it does.
+type p2pSession struct {
+	mu sync.Mutex
+
+	FileName string
+	FileSize int64
+	Offer    string
+	Answer   string
+
+	ExpiresAt time.Time
+
+	offererConn               *websocket.Conn
+	answererConn              *websocket.Conn
+	pendingOffererCandidates  []string
+	pendingAnswererCandidates []string
+}
+
+var (
+	p2pSessionsMu sync.Mutex
+	p2pSessions   = map[string]*p2pSession{}
+)
+
+// registerP2PHandlers wires up the signaling endpoints only; there is no
+// "store & forward" vs "direct P2P" toggle or RTCPeerConnection/
+// RTCDataChannel client code in the embedded frontend that calls them.
+func registerP2PHandlers(e *echo.Echo) {
+	e.POST("/p2p/offer", handleP2POffer)
+	e.GET("/p2p/:code", handleP2PGetOffer)
+	e.POST("/p2p/:code/answer", handleP2PAnswer)
+	e.GET("/p2p/:code/ice", handleP2PIce)
+}
+
+// handleP2POffer registers a sender's SDP offer and file metadata under a
+// short code the sender can share with the receiver out of band.
+func handleP2POffer(c echo.Context) error {
+	sdp := c.FormValue("sdp")
+	if sdp == "" {
+		return handleError(c, errors.New("sdp is required"), http.StatusBadRequest)
+	}
+	fileName := c.FormValue("fileName")
+	fileSize, err := strconv.ParseInt(c.FormValue("fileSize"), 10, 64)
+	if err != nil {
+		return handleError(c, fmt.Errorf("invalid fileSize: %v", err), http.StatusBadRequest)
+	}
+
+	code, err := generateP2PCode()
+	if err != nil {
+		return handleError(c, fmt.Errorf("error generating code: %v", err), http.StatusInternalServerError)
+	}
+
+	p2pSessionsMu.Lock()
+	p2pSessions[code] = &p2pSession{
+		FileName:  fileName,
+		FileSize:  fileSize,
+		Offer:     sdp,
+		ExpiresAt: time.Now().Add(p2pSessionTTL),
+	}
+	p2pSessionsMu.Unlock()
+
+	return c.JSON(http.StatusOK, map[string]string{"code": code})
+}
+
+// handleP2PGetOffer lets the receiver fetch the sender's offer and file
+// metadata before posting an answer.
+func handleP2PGetOffer(c echo.Context) error {
+	session, err := getP2PSession(c.Param("code"))
+	if err != nil {
+		return handleError(c, err, http.StatusNotFound)
+	}
+
+	session.mu.Lock()
+	defer session.mu.Unlock()
+
+	return c.JSON(http.StatusOK, map[string]any{
+		"sdp":      session.Offer,
+		"fileName": session.FileName,
+		"fileSize": session.FileSize,
+	})
+}
+
+func handleP2PAnswer(c echo.Context) error {
+	session, err := getP2PSession(c.Param("code"))
+	if err != nil {
+		return handleError(c, err, http.StatusNotFound)
+	}
+
+	sdp := c.FormValue("sdp")
+	if sdp == "" {
+		return handleError(c, errors.New("sdp is required"), http.StatusBadRequest)
+	}
+
+	session.mu.Lock()
+	// Only the first answer is accepted: once a receiver has claimed the
+	// code, a second party racing (or brute-forcing) the same code can't
+	// overwrite it and hijack the transfer.
+	if session.Answer != "" {
+		session.mu.Unlock()
+		return handleError(c, errors.New("p2p session already answered"), http.StatusConflict)
+	}
+	session.Answer = sdp
+	session.mu.Unlock()
+
+	return c.NoContent(http.StatusOK)
+}
+
+func getP2PSession(code string) (*p2pSession, error) {
+	p2pSessionsMu.Lock()
+	session, ok := p2pSessions[code]
+	p2pSessionsMu.Unlock()
+	if !ok {
+		return nil, errors.New("p2p session not found")
+	}
+
+	session.mu.Lock()
+	expired := time.Now().After(session.ExpiresAt)
+	session.mu.Unlock()
+	if expired {
+		return nil, errors.New("p2p session has expired")
+	}
+
+	return session, nil
+}
+
+// handleP2PIce upgrades to a websocket and relays trickle-ICE candidates
+// between the offerer and answerer of a session. The server treats each
+// message as an opaque string and forwards it verbatim to the other side.
+func handleP2PIce(c echo.Context) error {
+	code := c.Param("code")
+	role := c.QueryParam("role")
+	if role != "offerer" && role != "answerer" {
+		return handleError(c, errors.New("role must be offerer or answerer"), http.StatusBadRequest)
+	}
+
+	session, err := getP2PSession(code)
+	if err != nil {
+		return handleError(c, err, http.StatusNotFound)
+	}
+
+	websocket.Handler(func(ws *websocket.Conn) {
+		defer ws.Close()
+		relayICE(session, role, ws)
+	}).ServeHTTP(c.Response(), c.Request())
+
+	return nil
+}
+
+func relayICE(session *p2pSession, role string, ws *websocket.Conn) {
+	session.mu.Lock()
+	if role == "offerer" {
+		session.offererConn = ws
+		for _, msg := range session.pendingAnswererCandidates {
+			websocket.Message.Send(ws, msg)
+		}
+		session.pendingAnswererCandidates = nil
+	} else {
+		session.answererConn = ws
+		for _, msg := range session.pendingOffererCandidates {
+			websocket.Message.Send(ws, msg)
+		}
+		session.pendingOffererCandidates = nil
+	}
+	session.mu.Unlock()
+
+	defer func() {
+		session.mu.Lock()
+		if role == "offerer" && session.offererConn == ws {
+			session.offererConn = nil
+		} else if role == "answerer" && session.answererConn == ws {
+			session.answererConn = nil
+		}
+		session.mu.Unlock()
+	}()
+
+	for {
+		var msg string
+		if err := websocket.Message.Receive(ws, &msg); err != nil {
+			return
+		}
+
+		session.mu.Lock()
+		peer := session.answererConn
+		if role == "answerer" {
+			peer = session.offererConn
+		}
+		if peer != nil {
+			websocket.Message.Send(peer, msg)
+		} else if role == "offerer" {
+			session.pendingOffererCandidates = append(session.pendingOffererCandidates, msg)
+		} else {
+			session.pendingAnswererCandidates = append(session.pendingAnswererCandidates, msg)
+		}
+		session.mu.Unlock()
+	}
+}
+
+func generateP2PCode() (string, error) {
+	b := make([]byte, p2pCodeSize)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func startP2PCleanupScheduler() {
+	ticker := time.NewTicker(p2pSweepPeriod)
+	go func() {
+		for range ticker.C {
+			sweepExpiredP2PSessions()
+		}
+	}()
+}
+
+func sweepExpiredP2PSessions() {
+	now := time.Now()
+	p2pSessionsMu.Lock()
+	defer p2pSessionsMu.Unlock()
+	for code, session := range p2pSessions {
+		session.mu.Lock()
+		expired := now.After(session.ExpiresAt)
+		session.mu.Unlock()
+		if expired {
+			delete(p2pSessions, code)
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// FSBackend stores each file's frames as <root>/<id>/<index>.bin on the
+// local filesystem.
+type FSBackend struct {
+	root string
+}
+
+func NewFSBackend(root string) *FSBackend {
+	return &FSBackend{root: root}
+}
+
+func (b *FSBackend) dir(id string) string {
+	return filepath.Join(b.root, id)
+}
+
+func (b *FSBackend) path(id string, index int) string {
+	return filepath.Join(b.dir(id), fmt.Sprintf("%d.bin", index))
+}
+
+func (b *FSBackend) PutChunk(ctx context.Context, id string, index int, r io.Reader) error {
+	if err := os.MkdirAll(b.dir(id), 0o755); err != nil {
+		return err
+	}
+
+	f, err := os.Create(b.path(id, index))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = io.Copy(f, r)
+	return err
+}
+
+func (b *FSBackend) GetChunk(ctx context.Context, id string, index int) (io.ReadCloser, error) {
+	return os.Open(b.path(id, index))
+}
+
+func (b *FSBackend) Stat(ctx context.Context, id string) (Meta, error) {
+	entries, err := os.ReadDir(b.dir(id))
+	if err != nil {
+		return Meta{}, err
+	}
+
+	info, err := os.Stat(b.dir(id))
+	if err != nil {
+		return Meta{}, err
+	}
+
+	return Meta{FrameCount: len(entries), CreatedAt: info.ModTime()}, nil
+}
+
+func (b *FSBackend) Delete(ctx context.Context, id string) error {
+	return os.RemoveAll(b.dir(id))
+}
+
+func (b *FSBackend) List(ctx context.Context, olderThan time.Time) ([]string, error) {
+	entries, err := os.ReadDir(b.root)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var ids []string
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return nil, err
+		}
+		if info.ModTime().Before(olderThan) {
+			ids = append(ids, entry.Name())
+		}
+	}
+	return ids, nil
+}
@@ -0,0 +1,77 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"io"
+	"time"
+)
+
+// PostgresBackend stores frames as rows in the existing "files" table. It is
+// the default backend and keeps the current behavior of everything living in
+// Postgres.
+type PostgresBackend struct {
+	db *sql.DB
+}
+
+func NewPostgresBackend(db *sql.DB) *PostgresBackend {
+	return &PostgresBackend{db: db}
+}
+
+func (b *PostgresBackend) PutChunk(ctx context.Context, id string, index int, r io.Reader) error {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+
+	_, err = b.db.ExecContext(ctx,
+		"INSERT INTO files (id, chunk_index, chunk_data, created_at) VALUES ($1, $2, $3, NOW()) ON CONFLICT (id, chunk_index) DO UPDATE SET chunk_data = EXCLUDED.chunk_data",
+		id, index, data)
+	return err
+}
+
+func (b *PostgresBackend) GetChunk(ctx context.Context, id string, index int) (io.ReadCloser, error) {
+	var data []byte
+	err := b.db.QueryRowContext(ctx, "SELECT chunk_data FROM files WHERE id = $1 AND chunk_index = $2", id, index).Scan(&data)
+	if err != nil {
+		return nil, err
+	}
+	return io.NopCloser(bytes.NewReader(data)), nil
+}
+
+func (b *PostgresBackend) Stat(ctx context.Context, id string) (Meta, error) {
+	var count int
+	var createdAt time.Time
+	err := b.db.QueryRowContext(ctx, "SELECT COUNT(*), MIN(created_at) FROM files WHERE id = $1", id).Scan(&count, &createdAt)
+	if err != nil {
+		return Meta{}, err
+	}
+	if count == 0 {
+		return Meta{}, sql.ErrNoRows
+	}
+	return Meta{FrameCount: count, CreatedAt: createdAt}, nil
+}
+
+func (b *PostgresBackend) Delete(ctx context.Context, id string) error {
+	_, err := b.db.ExecContext(ctx, "DELETE FROM files WHERE id = $1", id)
+	return err
+}
+
+func (b *PostgresBackend) List(ctx context.Context, olderThan time.Time) ([]string, error) {
+	rows, err := b.db.QueryContext(ctx, "SELECT DISTINCT id FROM files WHERE created_at < $1", olderThan)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
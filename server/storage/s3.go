@@ -0,0 +1,92 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+)
+
+// S3Backend stores each file's frames as objects under "<id>/<index>.bin" in
+// a single bucket, via any S3-compatible endpoint (AWS S3, SeaweedFS, MinIO).
+type S3Backend struct {
+	client *minio.Client
+	bucket string
+}
+
+func NewS3Backend(client *minio.Client, bucket string) *S3Backend {
+	return &S3Backend{client: client, bucket: bucket}
+}
+
+func (b *S3Backend) key(id string, index int) string {
+	return fmt.Sprintf("%s/%d.bin", id, index)
+}
+
+func (b *S3Backend) PutChunk(ctx context.Context, id string, index int, r io.Reader) error {
+	_, err := b.client.PutObject(ctx, b.bucket, b.key(id, index), r, -1, minio.PutObjectOptions{})
+	return err
+}
+
+func (b *S3Backend) GetChunk(ctx context.Context, id string, index int) (io.ReadCloser, error) {
+	return b.client.GetObject(ctx, b.bucket, b.key(id, index), minio.GetObjectOptions{})
+}
+
+func (b *S3Backend) Stat(ctx context.Context, id string) (Meta, error) {
+	objects := b.client.ListObjects(ctx, b.bucket, minio.ListObjectsOptions{Prefix: id + "/", Recursive: true})
+
+	var meta Meta
+	for obj := range objects {
+		if obj.Err != nil {
+			return Meta{}, obj.Err
+		}
+		meta.FrameCount++
+		if meta.CreatedAt.IsZero() || obj.LastModified.Before(meta.CreatedAt) {
+			meta.CreatedAt = obj.LastModified
+		}
+	}
+	if meta.FrameCount == 0 {
+		return Meta{}, fmt.Errorf("no frames found for %q", id)
+	}
+	return meta, nil
+}
+
+func (b *S3Backend) Delete(ctx context.Context, id string) error {
+	objects := b.client.ListObjects(ctx, b.bucket, minio.ListObjectsOptions{Prefix: id + "/", Recursive: true})
+	for obj := range objects {
+		if obj.Err != nil {
+			return obj.Err
+		}
+		if err := b.client.RemoveObject(ctx, b.bucket, obj.Key, minio.RemoveObjectOptions{}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *S3Backend) List(ctx context.Context, olderThan time.Time) ([]string, error) {
+	seen := map[string]bool{}
+	var ids []string
+
+	objects := b.client.ListObjects(ctx, b.bucket, minio.ListObjectsOptions{Recursive: true})
+	for obj := range objects {
+		if obj.Err != nil {
+			return nil, obj.Err
+		}
+		if !obj.LastModified.Before(olderThan) {
+			continue
+		}
+
+		id := obj.Key
+		if i := strings.LastIndex(id, "/"); i >= 0 {
+			id = id[:i]
+		}
+		if !seen[id] {
+			seen[id] = true
+			ids = append(ids, id)
+		}
+	}
+	return ids, nil
+}
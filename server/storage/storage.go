@@ -0,0 +1,27 @@
+// Package storage abstracts where encrypted file frames live so the server
+// can keep large blobs out of Postgres TOAST and instead target a local
+// filesystem or an S3-compatible bucket, selected at startup via -storage.
+package storage
+
+import (
+	"context"
+	"io"
+	"time"
+)
+
+// Meta describes a stored file's frames without reading their contents.
+type Meta struct {
+	FrameCount int
+	CreatedAt  time.Time
+}
+
+// Backend stores and retrieves the encrypted frames that make up a file.
+// Frames for a given id are addressed by a zero-based index and are written
+// and read independently so callers never need the whole file in memory.
+type Backend interface {
+	PutChunk(ctx context.Context, id string, index int, r io.Reader) error
+	GetChunk(ctx context.Context, id string, index int) (io.ReadCloser, error)
+	Stat(ctx context.Context, id string) (Meta, error)
+	Delete(ctx context.Context, id string) error
+	List(ctx context.Context, olderThan time.Time) ([]string, error)
+}